@@ -0,0 +1,381 @@
+// Package journal makes scramble/downgrade runs resumable and
+// reversible: before either command touches the graph, it records the
+// full plan of renames and file rewrites it is about to perform, so a
+// run killed partway through can be finished with --resume or undone
+// with --rollback instead of leaving the graph half-migrated.
+package journal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	fileName      = ".graphutil-journal.json"
+	backupDirName = ".graphutil-journal-backups"
+)
+
+// Rename is a single planned graph/<id> -> graph/<newID> move.
+type Rename struct {
+	Old  string `json:"old"`
+	New  string `json:"new"`
+	Done bool   `json:"done"`
+}
+
+// Rewrite is a single planned in-place file rewrite. SHA256 is the
+// pre-image digest recorded at plan time, and Backup is the sidecar
+// copy of the original content used to undo the rewrite on rollback.
+// Managed rewrites are snapshotted the same way but are produced and
+// marked done by their own dedicated step rather than by
+// updateReferences' generic regex substitution; Pending excludes them.
+type Rewrite struct {
+	Path    string `json:"path"`
+	SHA256  string `json:"sha256"`
+	Backup  string `json:"backup"`
+	Done    bool   `json:"done"`
+	Managed bool   `json:"managed,omitempty"`
+}
+
+// Cleanup is a path created as a side effect of a managed step (for
+// example the new content-addressed file or metadata dir rehashImages
+// creates when an image's id changes) that has no "original content"
+// of its own to restore. Rollback simply removes it once every
+// Rewrite and Rename ahead of it has put the rest of the tree back.
+type Cleanup struct {
+	Path string `json:"path"`
+}
+
+// Journal is the on-disk plan for a single scramble/downgrade run.
+type Journal struct {
+	path string
+	mu   sync.Mutex
+
+	// Parallel is the number of workers ApplyRenames fans out across.
+	// Zero means runtime.NumCPU().
+	Parallel int
+
+	Renames  []*Rename  `json:"renames"`
+	Rewrites []*Rewrite `json:"rewrites"`
+	Cleanups []*Cleanup `json:"cleanups"`
+}
+
+// Path returns the journal file location for a graph directory.
+func Path(graphDir string) string {
+	return filepath.Join(graphDir, fileName)
+}
+
+// backupDir returns the directory rewrite snapshots are kept in,
+// alongside the journal file.
+func (j *Journal) backupDir() string {
+	return filepath.Join(filepath.Dir(j.path), backupDirName)
+}
+
+// New creates an empty journal for graphDir. Call Save after
+// populating it with Renames/Rewrites to persist the plan.
+func New(graphDir string) *Journal {
+	return &Journal{path: Path(graphDir)}
+}
+
+// Load reads the journal for graphDir, returning (nil, nil) if none
+// exists.
+func Load(graphDir string) (*Journal, error) {
+	path := Path(graphDir)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	j := &Journal{path: path}
+	if err := json.Unmarshal(content, j); err != nil {
+		return nil, fmt.Errorf("parsing journal %s: %s", path, err)
+	}
+	return j, nil
+}
+
+// Save writes the journal to disk.
+func (j *Journal) Save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.save()
+}
+
+// save writes the journal to disk without acquiring mu; callers must
+// already hold it.
+func (j *Journal) save() error {
+	content, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.path, content, 0600)
+}
+
+// Remove deletes the journal file, used once a run completes
+// successfully.
+func (j *Journal) Remove() error {
+	if err := os.RemoveAll(j.backupDir()); err != nil {
+		return err
+	}
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// AddRename records a planned graph dir rename.
+func (j *Journal) AddRename(oldPath, newPath string) {
+	j.Renames = append(j.Renames, &Rename{Old: oldPath, New: newPath})
+}
+
+// AddRewrite records a planned in-place rewrite of path, snapshotting
+// its current content to a backup sidecar so Rollback can restore it.
+// It is a no-op if path does not exist yet.
+func (j *Journal) AddRewrite(path string) error {
+	return j.AddRewriteSnapshot(path, path)
+}
+
+// AddRewriteSnapshot is like AddRewrite, but reads the pre-image from
+// snapshotPath instead of path. This is needed when a rewrite targets
+// a file that only exists after a still-pending rename (e.g. a rename
+// from graph/<id> to graph/<newID> is planned but not yet applied, so
+// the to-be-rewritten graph/<newID>/json must be snapshotted from
+// graph/<id>/json). Backups are kept in a directory next to the
+// journal file itself, keyed by content digest, rather than alongside
+// path: path's directory may not exist yet at plan time (the pending
+// rename above), and in the snapshot-path case path's directory is
+// about to be renamed away entirely, which would strand a sidecar
+// written next to it.
+func (j *Journal) AddRewriteSnapshot(snapshotPath, path string) error {
+	content, err := ioutil.ReadFile(snapshotPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sum := sha256.Sum256(content)
+	backup := filepath.Join(j.backupDir(), hex.EncodeToString(sum[:]))
+	if err := os.MkdirAll(filepath.Dir(backup), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(backup, content, 0600); err != nil {
+		return err
+	}
+	j.Rewrites = append(j.Rewrites, &Rewrite{
+		Path:   path,
+		SHA256: hex.EncodeToString(sum[:]),
+		Backup: backup,
+	})
+	return nil
+}
+
+// AddCleanup records path as a side-effect artifact of a managed step
+// that Rollback should remove once the step is undone, since path has
+// no pre-image to restore it to.
+func (j *Journal) AddCleanup(path string) {
+	j.Cleanups = append(j.Cleanups, &Cleanup{Path: path})
+}
+
+// Pending returns the unmanaged rewrite paths that have not yet been
+// marked done, preserving plan order. Callers use this to drive
+// updateReferences on resumed runs; managed rewrites are excluded
+// since their owning step drives its own resume logic.
+func (j *Journal) Pending() []string {
+	var paths []string
+	for _, r := range j.Rewrites {
+		if !r.Done && !r.Managed {
+			paths = append(paths, r.Path)
+		}
+	}
+	return paths
+}
+
+// AddManagedRewriteSnapshot is like AddRewriteSnapshot, but marks the
+// rewrite as managed: see Rewrite.Managed.
+func (j *Journal) AddManagedRewriteSnapshot(snapshotPath, path string) error {
+	if err := j.AddRewriteSnapshot(snapshotPath, path); err != nil {
+		return err
+	}
+	if n := len(j.Rewrites); n > 0 && j.Rewrites[n-1].Path == path {
+		j.Rewrites[n-1].Managed = true
+	}
+	return nil
+}
+
+// ManagedDone reports whether every managed rewrite has already been
+// applied, so a caller like RewriteV2Store's invocation can skip
+// re-running an idempotent-but-expensive step on --resume. It returns
+// false if there are no managed rewrites at all.
+func (j *Journal) ManagedDone() bool {
+	any := false
+	for _, r := range j.Rewrites {
+		if !r.Managed {
+			continue
+		}
+		any = true
+		if !r.Done {
+			return false
+		}
+	}
+	return any
+}
+
+// MarkRewriteDone records that path's rewrite has completed.
+func (j *Journal) MarkRewriteDone(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, r := range j.Rewrites {
+		if r.Path == path {
+			r.Done = true
+			return
+		}
+	}
+}
+
+// MarkManagedDone records that every managed rewrite has completed,
+// used once a managed step (like RewriteV2Store) returns successfully.
+func (j *Journal) MarkManagedDone() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, r := range j.Rewrites {
+		if r.Managed {
+			r.Done = true
+		}
+	}
+}
+
+// ApplyRenames performs every rename not yet marked done, fanning the
+// work out across j.Parallel workers (default runtime.NumCPU()) since
+// each rename touches an independent directory. A failed rename does
+// not stop its peers; all failures are aggregated into one error.
+func (j *Journal) ApplyRenames() error {
+	parallel := j.Parallel
+	if parallel <= 0 {
+		parallel = runtime.NumCPU()
+	}
+
+	var pending []*Rename
+	for _, r := range j.Renames {
+		if !r.Done {
+			pending = append(pending, r)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	renameCh := make(chan *Rename)
+	errCh := make(chan error, len(pending))
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range renameCh {
+				if err := os.Rename(r.Old, r.New); err != nil {
+					errCh <- fmt.Errorf("renaming %s to %s: %s", r.Old, r.New, err)
+					continue
+				}
+				j.mu.Lock()
+				r.Done = true
+				saveErr := j.save()
+				j.mu.Unlock()
+				if saveErr != nil {
+					errCh <- saveErr
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for _, r := range pending {
+			renameCh <- r
+		}
+		close(renameCh)
+	}()
+
+	wg.Wait()
+	close(errCh)
+
+	var errs []string
+	for err := range errCh {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d rename(s) failed:\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Plan renders the journal's steps for --dry-run output.
+func (j *Journal) Plan() []string {
+	var lines []string
+	for _, r := range j.Renames {
+		lines = append(lines, fmt.Sprintf("rename %s -> %s", r.Old, r.New))
+	}
+	for _, r := range j.Rewrites {
+		lines = append(lines, fmt.Sprintf("rewrite %s", r.Path))
+	}
+	for _, c := range j.Cleanups {
+		lines = append(lines, fmt.Sprintf("create %s", c.Path))
+	}
+	return lines
+}
+
+// Rollback reverses every completed rename (in reverse order),
+// restores every rewritten file from its backup, and removes every
+// cleanup artifact, then removes the journal and backups.
+func (j *Journal) Rollback() error {
+	for i := len(j.Rewrites) - 1; i >= 0; i-- {
+		r := j.Rewrites[i]
+		if !r.Done {
+			continue
+		}
+		backup, err := ioutil.ReadFile(r.Backup)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("reading backup %s: %s", r.Backup, err)
+		}
+		// r.Path's directory may itself have been renamed away by a
+		// managed step (e.g. rehashImages renaming
+		// imagedb/metadata/sha256/<oldID> to .../<newID>) since the
+		// rewrite was planned, so recreate it before restoring.
+		if err := os.MkdirAll(filepath.Dir(r.Path), 0700); err != nil {
+			return fmt.Errorf("recreating %s: %s", filepath.Dir(r.Path), err)
+		}
+		if err := ioutil.WriteFile(r.Path, backup, 0600); err != nil {
+			return fmt.Errorf("restoring %s: %s", r.Path, err)
+		}
+	}
+
+	for _, c := range j.Cleanups {
+		if err := os.RemoveAll(c.Path); err != nil {
+			return fmt.Errorf("removing %s: %s", c.Path, err)
+		}
+	}
+
+	for i := len(j.Renames) - 1; i >= 0; i-- {
+		r := j.Renames[i]
+		if !r.Done {
+			continue
+		}
+		if err := os.Rename(r.New, r.Old); err != nil {
+			return fmt.Errorf("reversing rename %s -> %s: %s", r.New, r.Old, err)
+		}
+		r.Done = false
+	}
+
+	return j.Remove()
+}
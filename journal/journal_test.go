@@ -0,0 +1,160 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustWriteFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("writing %s: %s", path, err)
+	}
+}
+
+func mustReadFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %s", path, err)
+	}
+	return string(content)
+}
+
+func TestApplyRenamesMovesDirAndMarksDone(t *testing.T) {
+	tmp := t.TempDir()
+	oldPath := filepath.Join(tmp, "old")
+	newPath := filepath.Join(tmp, "new")
+	if err := os.Mkdir(oldPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	j := New(tmp)
+	j.AddRename(oldPath, newPath)
+
+	if err := j.ApplyRenames(); err != nil {
+		t.Fatalf("ApplyRenames: %s", err)
+	}
+
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be gone, got err=%v", oldPath, err)
+	}
+	if _, err := os.Stat(newPath); err != nil {
+		t.Fatalf("expected %s to exist: %s", newPath, err)
+	}
+	if !j.Renames[0].Done {
+		t.Fatal("expected rename to be marked done")
+	}
+}
+
+func TestRollbackRestoresRenamesAndContent(t *testing.T) {
+	tmp := t.TempDir()
+	oldPath := filepath.Join(tmp, "old")
+	newPath := filepath.Join(tmp, "new")
+	if err := os.Mkdir(oldPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(oldPath, "json")
+	mustWriteFile(t, jsonPath, `{"id":"original"}`)
+
+	j := New(tmp)
+	j.AddRename(oldPath, newPath)
+	if err := j.AddRewriteSnapshot(jsonPath, filepath.Join(newPath, "json")); err != nil {
+		t.Fatalf("AddRewriteSnapshot: %s", err)
+	}
+	if err := j.Save(); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	if err := j.ApplyRenames(); err != nil {
+		t.Fatalf("ApplyRenames: %s", err)
+	}
+	rewrittenPath := filepath.Join(newPath, "json")
+	mustWriteFile(t, rewrittenPath, `{"id":"scrambled"}`)
+	j.MarkRewriteDone(rewrittenPath)
+
+	if err := j.Rollback(); err != nil {
+		t.Fatalf("Rollback: %s", err)
+	}
+
+	if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be gone after rollback, got err=%v", newPath, err)
+	}
+	if got := mustReadFile(t, jsonPath); got != `{"id":"original"}` {
+		t.Fatalf("expected original content restored, got %q", got)
+	}
+	if _, err := os.Stat(Path(tmp)); !os.IsNotExist(err) {
+		t.Fatal("expected journal file to be removed after rollback")
+	}
+}
+
+func TestResumeSkipsCompletedRenames(t *testing.T) {
+	tmp := t.TempDir()
+	doneOld := filepath.Join(tmp, "done-old")
+	doneNew := filepath.Join(tmp, "done-new")
+	pendingOld := filepath.Join(tmp, "pending-old")
+	pendingNew := filepath.Join(tmp, "pending-new")
+	if err := os.Mkdir(doneNew, 0700); err != nil { // already applied
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(pendingOld, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	j := New(tmp)
+	j.AddRename(doneOld, doneNew)
+	j.Renames[0].Done = true
+	j.AddRename(pendingOld, pendingNew)
+	if err := j.Save(); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	resumed, err := Load(tmp)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if resumed == nil {
+		t.Fatal("expected a journal to be loaded")
+	}
+
+	if err := resumed.ApplyRenames(); err != nil {
+		t.Fatalf("ApplyRenames: %s", err)
+	}
+	if _, err := os.Stat(pendingNew); err != nil {
+		t.Fatalf("expected pending rename to be applied: %s", err)
+	}
+	if !resumed.Renames[0].Done || !resumed.Renames[1].Done {
+		t.Fatal("expected every rename to be marked done after resume")
+	}
+}
+
+func TestPendingExcludesManagedRewrites(t *testing.T) {
+	tmp := t.TempDir()
+	plainPath := filepath.Join(tmp, "plain")
+	managedPath := filepath.Join(tmp, "managed")
+	mustWriteFile(t, plainPath, "a")
+	mustWriteFile(t, managedPath, "b")
+
+	j := New(tmp)
+	if err := j.AddRewriteSnapshot(plainPath, plainPath); err != nil {
+		t.Fatalf("AddRewriteSnapshot: %s", err)
+	}
+	if err := j.AddManagedRewriteSnapshot(managedPath, managedPath); err != nil {
+		t.Fatalf("AddManagedRewriteSnapshot: %s", err)
+	}
+
+	pending := j.Pending()
+	if len(pending) != 1 || pending[0] != plainPath {
+		t.Fatalf("expected only %s pending, got %v", plainPath, pending)
+	}
+
+	if j.ManagedDone() {
+		t.Fatal("expected ManagedDone to be false before the managed rewrite completes")
+	}
+	j.MarkManagedDone()
+	if !j.ManagedDone() {
+		t.Fatal("expected ManagedDone to be true after MarkManagedDone")
+	}
+}
@@ -7,23 +7,44 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/stringid"
 	"github.com/spf13/cobra"
+
+	"github.com/dmcgowan/graphutil/journal"
+	"github.com/dmcgowan/graphutil/migrate"
+	"github.com/dmcgowan/graphutil/verify"
 )
 
 var (
-	verbose  bool
-	graphdir string
-	driver   string
+	verbose      bool
+	graphdir     string
+	driver       string
+	migrateJobs  int
+	layout       string
+	resume       bool
+	rollback     bool
+	dryRun       bool
+	fix          bool
+	parallelJobs int
 
 	ErrNoGraphDriver = errors.New("no graph driver set")
 	ErrNeedMigration = errors.New("migration needed")
 )
 
+func parallelism() int {
+	if parallelJobs > 0 {
+		return parallelJobs
+	}
+	return runtime.NumCPU()
+}
+
 func main() {
 	cmd := &cobra.Command{
 		Use:   "graphutil",
@@ -40,6 +61,11 @@ func main() {
 		Long:  "",
 		Run:   runScramble,
 	}
+	scrambleCommand.Flags().StringVar(&layout, "layout", "auto", "graph layout to scramble: v1, v2, or auto")
+	scrambleCommand.Flags().BoolVar(&resume, "resume", false, "resume an interrupted run from its journal")
+	scrambleCommand.Flags().BoolVar(&rollback, "rollback", false, "reverse an interrupted run using its journal")
+	scrambleCommand.Flags().BoolVar(&dryRun, "dry-run", false, "print the planned changes without touching disk")
+	scrambleCommand.Flags().IntVar(&parallelJobs, "parallel", 0, "number of images to process concurrently (default: number of CPUs)")
 
 	downgradeCommand := &cobra.Command{
 		Use:   "downgrade",
@@ -47,9 +73,30 @@ func main() {
 		Long:  "",
 		Run:   runDowngrade,
 	}
+	downgradeCommand.Flags().StringVar(&layout, "layout", "auto", "graph layout to downgrade: v1, v2, or auto")
+	downgradeCommand.Flags().BoolVar(&resume, "resume", false, "resume an interrupted run from its journal")
+	downgradeCommand.Flags().BoolVar(&rollback, "rollback", false, "reverse an interrupted run using its journal")
+	downgradeCommand.Flags().BoolVar(&dryRun, "dry-run", false, "print the planned changes without touching disk")
+	downgradeCommand.Flags().IntVar(&parallelJobs, "parallel", 0, "number of images to process concurrently (default: number of CPUs)")
 	// TODO: Add flag for version
 
-	cmd.AddCommand(scrambleCommand, downgradeCommand)
+	migrateCommand := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrates the graph directory from the v1 to the v2 image store",
+		Long:  "",
+		Run:   runMigrate,
+	}
+	migrateCommand.Flags().IntVar(&migrateJobs, "parallel", 0, "number of images to migrate concurrently (default: number of CPUs)")
+
+	verifyCommand := &cobra.Command{
+		Use:   "verify",
+		Short: "Checks the graph directory for corruption and recomputes layer checksums",
+		Long:  "",
+		Run:   runVerify,
+	}
+	verifyCommand.Flags().BoolVar(&fix, "fix", false, "drop dangling repository references and delete orphaned graph entries")
+
+	cmd.AddCommand(scrambleCommand, downgradeCommand, migrateCommand, verifyCommand)
 
 	cmd.Execute()
 }
@@ -65,6 +112,13 @@ func globalFlags(cmd *cobra.Command) {
 	}
 }
 
+func resolveLayout() string {
+	if layout == "" || layout == "auto" {
+		return migrate.DetectLayout(graphdir, driver)
+	}
+	return layout
+}
+
 func getCacheDir(image string) (string, error) {
 	if driver == "" {
 		return "", ErrNoGraphDriver
@@ -81,160 +135,531 @@ func getCacheDir(image string) (string, error) {
 	return filepath.Join(graphdir, driver, cacheID), nil
 }
 
-func updateReferences(mapping map[string]string, paths []string) {
+// updateReferences rewrites 64-hex id references in paths according to
+// mapping. If j is non-nil, each path is marked done in the journal
+// once it has been processed (successfully or not), so a --resume run
+// does not reprocess it. paths are independent of each other, so they
+// are fanned out across parallelism() workers.
+func updateReferences(mapping map[string]string, paths []string, j *journal.Journal) {
 	r := regexp.MustCompile(`"[a-fA-F0-9]{64}"`)
 
-	for _, filePath := range paths {
-		content, err := ioutil.ReadFile(filePath)
-		if err != nil {
-			logrus.Errorf("Error reading file %s: %s", filePath, err)
+	pathCh := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filePath := range pathCh {
+				updateReferenceFile(r, mapping, filePath, j)
+			}
+		}()
+	}
+	for _, p := range paths {
+		pathCh <- p
+	}
+	close(pathCh)
+	wg.Wait()
+}
+
+// updateReferenceFile rewrites 64-hex id references in a single file.
+// logrus's standard logger is safe for concurrent use, so callers may
+// invoke this from multiple goroutines without additional locking.
+func updateReferenceFile(r *regexp.Regexp, mapping map[string]string, filePath string, j *journal.Journal) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		logrus.Errorf("Error reading file %s: %s", filePath, err)
+		return
+	}
+
+	indexes := r.FindAllIndex(content, -1)
+	if len(indexes) == 0 {
+		logrus.Debugf("No matches found in %s", filePath)
+		if j != nil {
+			j.MarkRewriteDone(filePath)
+		}
+		return
+	}
+	logrus.Debugf("Found %d matches in %s", len(indexes), filePath)
+	var changed int
+	for _, rng := range indexes {
+		if rng[1]-rng[0] != 66 {
+			logrus.Errorf("Bad range %s: %d %d", filePath, rng[0], rng[1])
 			continue
 		}
 
-		indexes := r.FindAllIndex(content, -1)
-		if len(indexes) == 0 {
-			logrus.Debugf("No matches found in %s", filePath)
-			continue
+		foundID := string(content[rng[0]+1 : rng[1]-1])
+		if newID, ok := mapping[foundID]; ok {
+			changed++
+			if n := copy(content[rng[0]+1:rng[1]-1], []byte(newID)); n != 64 {
+				logrus.Errorf("Bad copy on %s: wrote %d bytes", filePath, n)
+			}
 		}
-		logrus.Debugf("Found %d matches in %s", len(indexes), filePath)
-		var changed int
-		for _, rng := range indexes {
-			if rng[1]-rng[0] != 66 {
-				logrus.Errorf("Bad range %s: %d %d", filePath, rng[0], rng[1])
-				continue
+
+	}
+	if changed > 0 {
+		if err := ioutil.WriteFile(filePath, content, 0600); err != nil {
+			logrus.Errorf("Error writing file %s: %s", filePath, err)
+		}
+		logrus.Debugf("Updated %s with %d changes", filePath, changed)
+	}
+	if j != nil {
+		j.MarkRewriteDone(filePath)
+	}
+}
+
+// scanGraphIDs walks graphdir's graph ids via migrate.WalkGraphIDs and
+// keeps the ones with a live cache dir, fanning the getCacheDir/os.Stat
+// checks out across parallelism() workers since each id is independent.
+// It returns ids sorted so the resulting plan is deterministic despite
+// the concurrent scan, and aggregates per-id errors into a single
+// returned error instead of aborting the scan on the first one.
+func scanGraphIDs(graphdir string) ([]string, error) {
+	var rawIDs []string
+	if err := migrate.WalkGraphIDs(graphdir, func(id string) error {
+		rawIDs = append(rawIDs, id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		id  string
+		ok  bool
+		err error
+	}
+
+	idCh := make(chan string)
+	resultCh := make(chan result)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range idCh {
+				cacheDir, err := getCacheDir(id)
+				if err != nil {
+					if err == ErrNeedMigration {
+						logrus.Debugf("%s not migrated", id)
+						resultCh <- result{id: id}
+						continue
+					}
+					resultCh <- result{id: id, err: fmt.Errorf("getting cache dir for %s: %s", id, err)}
+					continue
+				}
+
+				if _, err := os.Stat(cacheDir); err != nil {
+					if os.IsNotExist(err) {
+						logrus.Debugf("Skipping, missing cache dir: %s", id)
+						resultCh <- result{id: id}
+						continue
+					}
+					resultCh <- result{id: id, err: fmt.Errorf("checking cache dir %s: %s", cacheDir, err)}
+					continue
+				}
+
+				resultCh <- result{id: id, ok: true}
 			}
+		}()
+	}
+
+	go func() {
+		for _, id := range rawIDs {
+			idCh <- id
+		}
+		close(idCh)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	var ids []string
+	var errs []string
+	for res := range resultCh {
+		if res.err != nil {
+			errs = append(errs, res.err.Error())
+			continue
+		}
+		if res.ok {
+			ids = append(ids, res.id)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%d image(s) failed to scan:\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// scanDowngradeIDs is scanGraphIDs' downgrade counterpart: besides
+// filtering to ids with a live cache dir, it needs each one's cacheID
+// since that is the id downgrade renames graph/<id> back to.
+func scanDowngradeIDs(graphdir string) (map[string]string, error) {
+	var rawIDs []string
+	if err := migrate.WalkGraphIDs(graphdir, func(id string) error {
+		rawIDs = append(rawIDs, id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
-			foundID := string(content[rng[0]+1 : rng[1]-1])
-			if newID, ok := mapping[foundID]; ok {
-				changed++
-				if n := copy(content[rng[0]+1:rng[1]-1], []byte(newID)); n != 64 {
-					logrus.Errorf("Bad copy on %s: wrote %d bytes", filePath, n)
+	type result struct {
+		id      string
+		cacheID string
+		err     error
+	}
+
+	idCh := make(chan string)
+	resultCh := make(chan result)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range idCh {
+				cacheDir, err := getCacheDir(id)
+				if err != nil {
+					if err == ErrNeedMigration {
+						logrus.Debugf("%s not migrated", id)
+						resultCh <- result{id: id}
+						continue
+					}
+					resultCh <- result{id: id, err: fmt.Errorf("getting cache dir for %s: %s", id, err)}
+					continue
 				}
+
+				if _, err := os.Stat(cacheDir); err != nil {
+					if os.IsNotExist(err) {
+						logrus.Debugf("Skipping, missing cache dir: %s", id)
+						resultCh <- result{id: id}
+						continue
+					}
+					resultCh <- result{id: id, err: fmt.Errorf("checking cache dir %s: %s", cacheDir, err)}
+					continue
+				}
+
+				resultCh <- result{id: id, cacheID: filepath.Base(cacheDir)}
 			}
+		}()
+	}
+
+	go func() {
+		for _, id := range rawIDs {
+			idCh <- id
+		}
+		close(idCh)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	cacheIDs := map[string]string{}
+	var errs []string
+	for res := range resultCh {
+		if res.err != nil {
+			errs = append(errs, res.err.Error())
+			continue
+		}
+		if res.cacheID != "" && res.cacheID != res.id {
+			cacheIDs[res.id] = res.cacheID
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%d image(s) failed to scan:\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+
+	return cacheIDs, nil
+}
+
+// loadOrPlanJournal returns the journal to execute for this run: the
+// journal resumed from disk when --resume is set, or a freshly built
+// plan otherwise. It handles --rollback and refusing to run over an
+// unacknowledged journal itself, so callers only need to run buildPlan
+// when a fresh journal is required.
+func loadOrPlanJournal(cmd *cobra.Command, buildPlan func() (*journal.Journal, map[string]string)) (*journal.Journal, map[string]string, bool) {
+	existing, err := journal.Load(graphdir)
+	if err != nil {
+		logrus.Fatalf("Error loading journal: %s", err)
+	}
+
+	if rollback {
+		if existing == nil {
+			logrus.Fatalf("No journal found at %s to roll back", journal.Path(graphdir))
+		}
+		if err := existing.Rollback(); err != nil {
+			logrus.Fatalf("Error rolling back: %s", err)
+		}
+		fmt.Fprintln(cmd.Out(), "Rolled back incomplete run")
+		return nil, nil, false
+	}
+
+	if existing != nil && !resume {
+		logrus.Fatalf("Found incomplete journal at %s; re-run with --resume or --rollback", journal.Path(graphdir))
+	}
 
+	if resume {
+		if existing == nil {
+			logrus.Fatalf("No journal found at %s to resume", journal.Path(graphdir))
+		}
+		existing.Parallel = parallelJobs
+		updates := map[string]string{}
+		for _, r := range existing.Renames {
+			updates[filepath.Base(r.Old)] = filepath.Base(r.New)
 		}
-		if changed > 0 {
-			if err := ioutil.WriteFile(filePath, content, 0600); err != nil {
-				logrus.Errorf("Error writing file %s: %s", filePath, err)
+		if dryRun {
+			for _, line := range existing.Plan() {
+				fmt.Fprintln(cmd.Out(), line)
 			}
-			logrus.Debugf("Updated %s with %d changes", filePath, changed)
+			return nil, nil, false
+		}
+		return existing, updates, true
+	}
+
+	j, updates := buildPlan()
+	j.Parallel = parallelJobs
+	if dryRun {
+		for _, line := range j.Plan() {
+			fmt.Fprintln(cmd.Out(), line)
 		}
+		return nil, nil, false
 	}
+	if err := j.Save(); err != nil {
+		logrus.Fatalf("Error saving journal: %s", err)
+	}
+	return j, updates, true
 }
 
 func runScramble(cmd *cobra.Command, args []string) {
 	globalFlags(cmd)
 
 	t1 := time.Now()
-	dir, err := ioutil.ReadDir(filepath.Join(graphdir, "graph"))
-	if err != nil {
-		logrus.Fatalf("Error reading graph dir: %s", err)
-	}
-	var ids = []string{}
-	for _, v := range dir {
-		id := v.Name()
-		if len(id) != 64 {
-			logrus.Debugf("Skipping: %s", v.Name())
-			continue
-		}
 
-		cacheDir, err := getCacheDir(id)
+	j, updates, ok := loadOrPlanJournal(cmd, func() (*journal.Journal, map[string]string) {
+		ids, err := scanGraphIDs(graphdir)
 		if err != nil {
-			if err == ErrNeedMigration {
-				logrus.Debugf("%s not migrated", id)
-			}
-			logrus.Fatalf("Error getting image IDs: %s", err)
+			logrus.Fatalf("Error scanning graph dir: %s", err)
 		}
 
-		if _, err := os.Stat(cacheDir); err != nil {
-			if os.IsNotExist(err) {
-				logrus.Debugf("Skipping, missing cache dir: %s", id)
-				continue
+		updates := map[string]string{}
+		repoPath := filepath.Join(graphdir, fmt.Sprintf("repositories-%s", driver))
+		j := journal.New(graphdir)
+		for _, id := range ids {
+			newID := stringid.GenerateRandomID()
+			updates[id] = newID
+
+			oldPath := filepath.Join(graphdir, "graph", id)
+			newPath := filepath.Join(graphdir, "graph", newID)
+			j.AddRename(oldPath, newPath)
+			if err := j.AddRewriteSnapshot(filepath.Join(oldPath, "json"), filepath.Join(newPath, "json")); err != nil {
+				logrus.Fatalf("Error snapshotting %s: %s", oldPath, err)
 			}
-			logrus.Fatalf("Error checking cache dir %s: %s", cacheDir, err)
 		}
-
-		ids = append(ids, id)
+		if err := j.AddRewriteSnapshot(repoPath, repoPath); err != nil {
+			logrus.Fatalf("Error snapshotting %s: %s", repoPath, err)
+		}
+		if resolveLayout() == "v2" {
+			if err := addV2Snapshots(j, graphdir, driver); err != nil {
+				logrus.Fatalf("Error snapshotting v2 image store: %s", err)
+			}
+		}
+		return j, updates
+	})
+	if !ok {
+		return
 	}
 
-	updates := map[string]string{}
-	fileUpdates := []string{
-		filepath.Join(graphdir, fmt.Sprintf("repositories-%s", driver)),
+	for _, r := range j.Renames {
+		if !r.Done {
+			fmt.Fprintf(cmd.Out(), "Scrambling %s\n", filepath.Base(r.Old))
+		}
+	}
+	if err := j.ApplyRenames(); err != nil {
+		logrus.Fatalf("Error applying renames: %s", err)
 	}
-	for _, id := range ids {
-		fmt.Fprintf(cmd.Out(), "Scrambling %s\n", id)
 
-		newID := stringid.GenerateRandomID()
-		updates[id] = newID
+	updateReferences(updates, j.Pending(), j)
 
-		oldPath := filepath.Join(graphdir, "graph", id)
-		newPath := filepath.Join(graphdir, "graph", newID)
-		if err := os.Rename(oldPath, newPath); err != nil {
-			logrus.Errorf("Error renaming %s to %s: %s", oldPath, newPath, err)
-			continue
+	if resolveLayout() == "v2" && !j.ManagedDone() {
+		v2Updates, err := migrate.RewriteV2Store(graphdir, driver, updates)
+		if err != nil {
+			logrus.Fatalf("Error rewriting v2 image store: %s", err)
+		}
+		for oldID, newID := range v2Updates {
+			logrus.Debugf("Image %s rehashed to %s", oldID, newID)
+		}
+		for _, p := range migrate.RehashedPaths(graphdir, driver, v2Updates) {
+			j.AddCleanup(p)
+		}
+		j.MarkManagedDone()
+		if err := j.Save(); err != nil {
+			logrus.Fatalf("Error saving journal: %s", err)
 		}
-
-		updates[id] = newID
-		fileUpdates = append(fileUpdates, filepath.Join(graphdir, "graph", newID, "json"))
 	}
 
-	updateReferences(updates, fileUpdates)
+	if err := j.Remove(); err != nil {
+		logrus.Errorf("Error removing journal: %s", err)
+	}
 
 	logrus.Debugf("Ran scramble in %s", time.Since(t1).String())
 }
 
-func runDowngrade(cmd *cobra.Command, args []string) {
+// addV2Snapshots records a managed (see journal.Rewrite) rewrite
+// snapshot for every file under image/<driver> that RewriteV2Store may
+// touch, so a run interrupted mid-rehash can be rolled back and the
+// step can be represented in --dry-run output and safely skipped on
+// --resume once it has completed.
+func addV2Snapshots(j *journal.Journal, graphdir, driver string) error {
+	content, raw, err := migrate.V2Paths(graphdir, driver)
+	if err != nil {
+		return err
+	}
+	for _, p := range append(content, raw...) {
+		if err := j.AddManagedRewriteSnapshot(p, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runMigrate(cmd *cobra.Command, args []string) {
+	globalFlags(cmd)
+
+	t1 := time.Now()
+
+	m := &migrate.Migrator{
+		GraphDir: graphdir,
+		Driver:   driver,
+		Parallel: migrateJobs,
+	}
+	results, err := m.Run()
+	for _, res := range results {
+		if res.Skipped {
+			logrus.Debugf("%s already migrated to %s", res.LegacyID, res.ImageID)
+			continue
+		}
+		fmt.Fprintf(cmd.Out(), "Migrated %s -> %s\n", res.LegacyID, res.ImageID)
+	}
+	if err != nil {
+		logrus.Fatalf("Error migrating graph: %s", err)
+	}
+
+	logrus.Debugf("Ran migrate in %s", time.Since(t1).String())
+}
+
+func runVerify(cmd *cobra.Command, args []string) {
 	globalFlags(cmd)
 
 	t1 := time.Now()
-	dir, err := ioutil.ReadDir(filepath.Join(graphdir, "graph"))
+
+	v := &verify.Verifier{
+		GraphDir: graphdir,
+		Driver:   driver,
+	}
+	findings, err := v.Run()
 	if err != nil {
-		logrus.Fatalf("Error reading graph dir: %s", err)
+		logrus.Fatalf("Error verifying graph: %s", err)
 	}
 
-	updates := map[string]string{}
-	fileUpdates := []string{
-		filepath.Join(graphdir, fmt.Sprintf("repositories-%s", driver)),
+	for _, f := range findings {
+		fmt.Fprintf(cmd.Out(), "%s %s: %s\n", f.ID, f.Kind, f.Detail)
 	}
-	for _, v := range dir {
-		id := v.Name()
-		if len(id) != 64 {
-			logrus.Debugf("Skipping: %s", v.Name())
-			continue
+
+	if fix && len(findings) > 0 {
+		if err := v.Fix(findings); err != nil {
+			logrus.Fatalf("Error fixing findings: %s", err)
 		}
+	}
+
+	logrus.Debugf("Ran verify in %s", time.Since(t1).String())
+
+	if len(findings) > 0 && !fix {
+		os.Exit(1)
+	}
+}
 
-		cacheDir, err := getCacheDir(id)
+func runDowngrade(cmd *cobra.Command, args []string) {
+	globalFlags(cmd)
+
+	t1 := time.Now()
+
+	j, updates, ok := loadOrPlanJournal(cmd, func() (*journal.Journal, map[string]string) {
+		updates, err := scanDowngradeIDs(graphdir)
 		if err != nil {
-			if err == ErrNeedMigration {
-				logrus.Debugf("%s not migrated", id)
-			}
-			logrus.Fatalf("Error getting image IDs: %s", err)
+			logrus.Fatalf("Error scanning graph dir: %s", err)
 		}
 
-		if _, err := os.Stat(cacheDir); err != nil {
-			if os.IsNotExist(err) {
-				logrus.Debugf("Skipping, missing cache dir: %s", id)
-				continue
-			}
-			logrus.Fatalf("Error checking cache dir %s: %s", cacheDir, err)
+		ids := make([]string, 0, len(updates))
+		for id := range updates {
+			ids = append(ids, id)
 		}
+		sort.Strings(ids)
 
-		cacheID := filepath.Base(cacheDir)
-		if cacheID != id {
+		repoPath := filepath.Join(graphdir, fmt.Sprintf("repositories-%s", driver))
+		j := journal.New(graphdir)
+		for _, id := range ids {
+			cacheID := updates[id]
 			logrus.Debugf("Moving %s back to %s", id, cacheID)
-			updates[id] = cacheID
 
 			oldPath := filepath.Join(graphdir, "graph", id)
 			newPath := filepath.Join(graphdir, "graph", cacheID)
-			if err := os.Rename(oldPath, newPath); err != nil {
-				logrus.Errorf("Error renaming %s to %s: %s", oldPath, newPath, err)
-				continue
+			j.AddRename(oldPath, newPath)
+			if err := j.AddRewriteSnapshot(filepath.Join(oldPath, "json"), filepath.Join(newPath, "json")); err != nil {
+				logrus.Fatalf("Error snapshotting %s: %s", oldPath, err)
+			}
+		}
+		if err := j.AddRewriteSnapshot(repoPath, repoPath); err != nil {
+			logrus.Fatalf("Error snapshotting %s: %s", repoPath, err)
+		}
+		if resolveLayout() == "v2" {
+			if err := addV2Snapshots(j, graphdir, driver); err != nil {
+				logrus.Fatalf("Error snapshotting v2 image store: %s", err)
 			}
-			fileUpdates = append(fileUpdates, filepath.Join(newPath, "json"))
 		}
+		return j, updates
+	})
+	if !ok {
+		return
+	}
+
+	for _, r := range j.Renames {
+		if !r.Done {
+			logrus.Debugf("Moving %s back to %s", filepath.Base(r.Old), filepath.Base(r.New))
+		}
+	}
+	if err := j.ApplyRenames(); err != nil {
+		logrus.Fatalf("Error applying renames: %s", err)
 	}
 
-	updateReferences(updates, fileUpdates)
+	updateReferences(updates, j.Pending(), j)
+
+	if resolveLayout() == "v2" && !j.ManagedDone() {
+		v2Updates, err := migrate.RewriteV2Store(graphdir, driver, updates)
+		if err != nil {
+			logrus.Fatalf("Error rewriting v2 image store: %s", err)
+		}
+		for oldID, newID := range v2Updates {
+			logrus.Debugf("Image %s rehashed to %s", oldID, newID)
+		}
+		for _, p := range migrate.RehashedPaths(graphdir, driver, v2Updates) {
+			j.AddCleanup(p)
+		}
+		j.MarkManagedDone()
+		if err := j.Save(); err != nil {
+			logrus.Fatalf("Error saving journal: %s", err)
+		}
+	}
+
+	if err := j.Remove(); err != nil {
+		logrus.Errorf("Error removing journal: %s", err)
+	}
 
 	logrus.Debugf("Ran downgrade in %s", time.Since(t1).String())
 }
@@ -0,0 +1,633 @@
+// Package migrate reconstructs the content-addressed v2 image and layer
+// store (as introduced by Docker 1.10) from the pre-1.10 "graph/<id>"
+// layout that the rest of this tool operates on.
+package migrate
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var idRegexp = regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
+
+// WalkGraphIDs calls fn for every legacy image id found directly under
+// graphDir/graph. It is the same directory walk runScramble and
+// runDowngrade use in main, factored out so migrate can share it.
+func WalkGraphIDs(graphDir string, fn func(id string) error) error {
+	entries, err := ioutil.ReadDir(filepath.Join(graphDir, "graph"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id := entry.Name()
+		if !idRegexp.MatchString(id) {
+			logrus.Debugf("Skipping: %s", id)
+			continue
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// V1Image is the legacy per-id config docker wrote to graph/<id>/json
+// prior to the 1.10 layer store.
+type V1Image struct {
+	ID              string          `json:"id"`
+	Parent          string          `json:"parent,omitempty"`
+	Comment         string          `json:"comment,omitempty"`
+	Created         time.Time       `json:"created"`
+	Container       string          `json:"container,omitempty"`
+	ContainerConfig json.RawMessage `json:"container_config,omitempty"`
+	DockerVersion   string          `json:"docker_version,omitempty"`
+	Author          string          `json:"author,omitempty"`
+	Config          json.RawMessage `json:"config,omitempty"`
+	Architecture    string          `json:"architecture,omitempty"`
+	OS              string          `json:"os,omitempty"`
+	Size            int64           `json:"Size,omitempty"`
+}
+
+// RootFS describes the ordered layer chain of a v2 image, mirroring
+// image.RootFS from docker/docker/image.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids,omitempty"`
+}
+
+// History is a single entry in a v2 image's build history.
+type History struct {
+	Created    time.Time `json:"created"`
+	Author     string    `json:"author,omitempty"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// V2Image is the content-addressed image config written under
+// image/<driver>/imagedb/content/sha256/<id> by the 1.10+ image store.
+// Its id is the sha256 of its own JSON encoding, so it must not be
+// mutated after ID has been computed.
+type V2Image struct {
+	V1Image
+	History []History `json:"history,omitempty"`
+	RootFS  *RootFS   `json:"rootfs,omitempty"`
+}
+
+// Result records what Migrate did with a single legacy image id.
+type Result struct {
+	LegacyID string
+	ImageID  string
+	ChainID  string
+	Skipped  bool
+}
+
+// Migrator walks a legacy v1 graph directory and reconstructs the
+// layerdb and imagedb trees that Docker 1.10+ expects under
+// image/<driver>.
+type Migrator struct {
+	GraphDir string
+	Driver   string
+	Parallel int
+
+	mu    sync.Mutex
+	diffs map[string]string // legacy id -> diffID hex, memoized across workers
+}
+
+func (m *Migrator) mappingPath() string {
+	return filepath.Join(m.GraphDir, ".migration-v1-images.json")
+}
+
+func (m *Migrator) loadMapping() (map[string]string, error) {
+	mapping := map[string]string{}
+	content, err := ioutil.ReadFile(m.mappingPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mapping, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &mapping); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+func (m *Migrator) saveMapping(mapping map[string]string) error {
+	content, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.mappingPath(), content, 0600)
+}
+
+// Run performs the migration, returning one Result per legacy id
+// encountered under graph/. Ids already recorded in
+// .migration-v1-images.json are skipped so repeated runs are
+// idempotent; the mapping is updated on disk before Run returns.
+func (m *Migrator) Run() ([]Result, error) {
+	parallel := m.Parallel
+	if parallel <= 0 {
+		parallel = runtime.NumCPU()
+	}
+
+	mapping, err := m.loadMapping()
+	if err != nil {
+		return nil, fmt.Errorf("loading migration mapping: %s", err)
+	}
+
+	var ids []string
+	if err := WalkGraphIDs(m.GraphDir, func(id string) error {
+		if _, err := m.cacheDir(id); err != nil {
+			if err == errNeedMigration {
+				logrus.Debugf("%s not migrated, skipping", id)
+				return nil
+			}
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if m.diffs == nil {
+		m.diffs = map[string]string{}
+	}
+	m.mu.Unlock()
+
+	// migrateOne needs its ancestors' v2 image ids (to set its own
+	// "parent" field), which only exist once those ancestors have been
+	// migrated. A v1 image's ancestry chain is always exactly one layer
+	// longer than its parent's, so grouping ids into waves by chain
+	// length and migrating wave-by-wave gives a strict parent-before-
+	// child barrier while still migrating everything in a wave (which
+	// can never include both an ancestor and its descendant) in
+	// parallel. mapping is only read by migrateOne, never written,
+	// while a wave's workers are running, so sharing it needs no lock.
+	waves, err := m.waveByChainLength(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	var errs []string
+	for _, wave := range waves {
+		waveResults, waveErrs := m.runWave(wave, mapping, parallel)
+		for _, res := range waveResults {
+			results = append(results, res)
+			mapping[res.LegacyID] = res.ImageID
+		}
+		errs = append(errs, waveErrs...)
+	}
+
+	if err := m.saveMapping(mapping); err != nil {
+		return results, fmt.Errorf("saving migration mapping: %s", err)
+	}
+	if len(errs) > 0 {
+		return results, fmt.Errorf("%d image(s) failed to migrate:\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+
+	if err := m.translateRepositories(mapping); err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// waveByChainLength groups ids into migration waves ordered by
+// ancestry chain length: since a v1 image's chain is always exactly
+// one layer longer than its parent's, every id in a wave is guaranteed
+// to be independent of every other id in that same wave.
+func (m *Migrator) waveByChainLength(ids []string) ([][]string, error) {
+	byLength := map[int][]string{}
+	maxLen := 0
+	for _, id := range ids {
+		chain, err := m.ancestry(id)
+		if err != nil {
+			return nil, fmt.Errorf("resolving ancestry for %s: %s", id, err)
+		}
+		n := len(chain)
+		byLength[n] = append(byLength[n], id)
+		if n > maxLen {
+			maxLen = n
+		}
+	}
+
+	var waves [][]string
+	for n := 1; n <= maxLen; n++ {
+		if wave, ok := byLength[n]; ok {
+			waves = append(waves, wave)
+		}
+	}
+	return waves, nil
+}
+
+// runWave migrates ids in parallel across parallel workers, consulting
+// mapping (read-only here; the caller merges results in once the wave
+// completes) to resolve each id's already-migrated ancestors.
+func (m *Migrator) runWave(ids []string, mapping map[string]string, parallel int) ([]Result, []string) {
+	idCh := make(chan string)
+	resultCh := make(chan Result)
+	errCh := make(chan error, len(ids))
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range idCh {
+				if imageID, ok := mapping[id]; ok {
+					resultCh <- Result{LegacyID: id, ImageID: imageID, Skipped: true}
+					continue
+				}
+				res, err := m.migrateOne(id, mapping)
+				if err != nil {
+					errCh <- fmt.Errorf("migrating %s: %s", id, err)
+					continue
+				}
+				resultCh <- res
+			}
+		}()
+	}
+
+	go func() {
+		for _, id := range ids {
+			idCh <- id
+		}
+		close(idCh)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	var results []Result
+	for res := range resultCh {
+		results = append(results, res)
+	}
+	close(errCh)
+
+	var errs []string
+	for err := range errCh {
+		errs = append(errs, err.Error())
+	}
+	return results, errs
+}
+
+var errNeedMigration = fmt.Errorf("migration needed")
+
+// cacheDir mirrors getCacheDir in main: it resolves the graph driver's
+// cache directory for a legacy id from graph/<id>/cache-id.
+func (m *Migrator) cacheDir(id string) (string, error) {
+	if m.Driver == "" {
+		return "", fmt.Errorf("no graph driver set")
+	}
+	cacheBytes, err := ioutil.ReadFile(filepath.Join(m.GraphDir, "graph", id, "cache-id"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errNeedMigration
+		}
+		return "", err
+	}
+	cacheID := strings.TrimSpace(string(cacheBytes))
+	dir := filepath.Join(m.GraphDir, m.Driver, cacheID)
+	if _, err := os.Stat(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// ReadV1Image reads and parses graph/<id>/json.
+func ReadV1Image(graphDir, id string) (*V1Image, error) {
+	content, err := ioutil.ReadFile(filepath.Join(graphDir, "graph", id, "json"))
+	if err != nil {
+		return nil, err
+	}
+	var v1 V1Image
+	if err := json.Unmarshal(content, &v1); err != nil {
+		return nil, err
+	}
+	return &v1, nil
+}
+
+// Ancestry returns id's parent chain in root-to-leaf order (including
+// id itself), following V1Image.Parent links under graph/.
+func Ancestry(graphDir, id string) ([]string, error) {
+	var chain []string
+	for cur := id; cur != ""; {
+		v1, err := ReadV1Image(graphDir, cur)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]string{cur}, chain...)
+		cur = v1.Parent
+	}
+	return chain, nil
+}
+
+func (m *Migrator) readV1Image(id string) (*V1Image, error) {
+	return ReadV1Image(m.GraphDir, id)
+}
+
+func (m *Migrator) readLayerSize(id string) (int64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(m.GraphDir, "graph", id, "layersize"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// DiffIDFromTarDataGz streams graph/<id>/tar-data.json.gz and returns
+// the sha256 digest of its layer contents, in the form Docker stores
+// as a layer DiffID.
+func DiffIDFromTarDataGz(graphDir, id string) (string, error) {
+	f, err := os.Open(filepath.Join(graphDir, "graph", id, "tar-data.json.gz"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+
+	digest, err := diffIDFromTarStream(gz)
+	if err != nil {
+		return "", fmt.Errorf("computing diffID for %s: %s", id, err)
+	}
+	return digest, nil
+}
+
+// diffID streams tar-data.json.gz for id and returns the sha256 digest
+// of its layer contents, memoizing per id since the same legacy layer
+// may be referenced while computing a descendant's diff chain.
+func (m *Migrator) diffID(id string) (string, error) {
+	m.mu.Lock()
+	if d, ok := m.diffs[id]; ok {
+		m.mu.Unlock()
+		return d, nil
+	}
+	m.mu.Unlock()
+
+	digest, err := DiffIDFromTarDataGz(m.GraphDir, id)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	m.diffs[id] = digest
+	m.mu.Unlock()
+
+	return digest, nil
+}
+
+// diffIDFromTarStream reads a tar stream (as reassembled from
+// tar-split, or the raw tar layer itself when no split metadata is
+// present) and returns its sha256 digest in the same form Docker
+// stores as a layer DiffID.
+func diffIDFromTarStream(r io.Reader) (string, error) {
+	h := sha256.New()
+	tr := tar.NewReader(io.TeeReader(r, h))
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// tar-data.json.gz is actually a tar-split asset stream on
+			// some Docker versions rather than a raw tar; fall back to
+			// hashing the remaining bytes verbatim so diffID is still
+			// stable across runs, matching upstream's fallback path.
+			if _, err := io.Copy(h, r); err != nil {
+				return "", err
+			}
+			break
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ChainID computes a v2 layer chain id from an ordered list of
+// diffIDs, the same algorithm layer.CreateChainID uses upstream.
+func ChainID(diffIDs []string) string {
+	if len(diffIDs) == 0 {
+		return ""
+	}
+	id := diffIDs[0]
+	for _, d := range diffIDs[1:] {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("sha256:%s sha256:%s", id, d)))
+		id = hex.EncodeToString(sum[:])
+	}
+	return id
+}
+
+func (m *Migrator) ancestry(id string) ([]string, error) {
+	return Ancestry(m.GraphDir, id)
+}
+
+// migrateOne migrates a single legacy id, resolving its parent's v2
+// image id from mapping (already populated for every shorter-chained
+// ancestor by Run's wave ordering).
+func (m *Migrator) migrateOne(id string, mapping map[string]string) (Result, error) {
+	chain, err := m.ancestry(id)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var diffIDs []string
+	var history []History
+	var parentChainID, parentImageID string
+
+	for _, layerID := range chain {
+		v1, err := m.readV1Image(layerID)
+		if err != nil {
+			return Result{}, err
+		}
+		diffID, err := m.diffID(layerID)
+		if err != nil {
+			return Result{}, err
+		}
+		size, err := m.readLayerSize(layerID)
+		if err != nil {
+			return Result{}, err
+		}
+		cacheDir, err := m.cacheDir(layerID)
+		if err != nil {
+			return Result{}, err
+		}
+
+		diffIDs = append(diffIDs, diffID)
+		layerChainID := ChainID(diffIDs)
+		if err := m.writeLayer(layerChainID, parentChainID, diffID, size, filepath.Base(cacheDir)); err != nil {
+			return Result{}, err
+		}
+		parentChainID = layerChainID
+
+		history = append(history, History{
+			Created:   v1.Created,
+			Author:    v1.Author,
+			CreatedBy: commandFromConfig(v1.ContainerConfig),
+			Comment:   v1.Comment,
+		})
+
+		if layerID != id {
+			if imageID, ok := mapping[layerID]; ok {
+				parentImageID = imageID
+			}
+		}
+	}
+
+	leaf, err := m.readV1Image(id)
+	if err != nil {
+		return Result{}, err
+	}
+
+	v2 := V2Image{
+		V1Image: *leaf,
+		History: history,
+		RootFS:  &RootFS{Type: "layers", DiffIDs: diffIDs},
+	}
+	v2.V1Image.Parent = parentImageID
+	v2.V1Image.ID = ""
+
+	configJSON, err := json.Marshal(v2)
+	if err != nil {
+		return Result{}, err
+	}
+	sum := sha256.Sum256(configJSON)
+	imageID := hex.EncodeToString(sum[:])
+
+	if err := m.writeImage(imageID, parentImageID, configJSON); err != nil {
+		return Result{}, err
+	}
+
+	return Result{LegacyID: id, ImageID: imageID, ChainID: parentChainID}, nil
+}
+
+func commandFromConfig(containerConfig json.RawMessage) string {
+	if len(containerConfig) == 0 {
+		return ""
+	}
+	var cfg struct {
+		Cmd []string `json:"Cmd"`
+	}
+	if err := json.Unmarshal(containerConfig, &cfg); err != nil {
+		return ""
+	}
+	return strings.Join(cfg.Cmd, " ")
+}
+
+func (m *Migrator) layerdbDir(chainID string) string {
+	return filepath.Join(m.GraphDir, "image", m.Driver, "layerdb", "sha256", chainID)
+}
+
+func (m *Migrator) writeLayer(chainID, parentChainID, diffID string, size int64, cacheID string) error {
+	dir := m.layerdbDir(chainID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "diff"), []byte("sha256:"+diffID), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "size"), []byte(strconv.FormatInt(size, 10)), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cache-id"), []byte(cacheID), 0600); err != nil {
+		return err
+	}
+	if parentChainID != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, "parent"), []byte("sha256:"+parentChainID), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) writeImage(imageID, parentImageID string, configJSON []byte) error {
+	contentDir := filepath.Join(m.GraphDir, "image", m.Driver, "imagedb", "content", "sha256")
+	if err := os.MkdirAll(contentDir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(contentDir, imageID), configJSON, 0600); err != nil {
+		return err
+	}
+
+	if parentImageID != "" {
+		metaDir := filepath.Join(m.GraphDir, "image", m.Driver, "imagedb", "metadata", "sha256", imageID)
+		if err := os.MkdirAll(metaDir, 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(metaDir, "parent"), []byte("sha256:"+parentImageID), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// translateRepositories rewrites repositories-<driver> (repo -> tag ->
+// legacy image id) into image/<driver>/repositories.json (repo -> tag
+// -> v2 image id) using mapping.
+func (m *Migrator) translateRepositories(mapping map[string]string) error {
+	legacyPath := filepath.Join(m.GraphDir, fmt.Sprintf("repositories-%s", m.Driver))
+	content, err := ioutil.ReadFile(legacyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var legacy struct {
+		Repositories map[string]map[string]string
+	}
+	if err := json.Unmarshal(content, &legacy); err != nil {
+		return fmt.Errorf("parsing %s: %s", legacyPath, err)
+	}
+
+	v2 := struct {
+		Repositories map[string]map[string]string
+	}{Repositories: map[string]map[string]string{}}
+
+	for repo, tags := range legacy.Repositories {
+		v2.Repositories[repo] = map[string]string{}
+		for tag, legacyID := range tags {
+			imageID, ok := mapping[legacyID]
+			if !ok {
+				logrus.Errorf("No migrated image for %s:%s (%s)", repo, tag, legacyID)
+				continue
+			}
+			v2.Repositories[repo][tag] = "sha256:" + imageID
+		}
+	}
+
+	out, err := json.MarshalIndent(v2, "", "  ")
+	if err != nil {
+		return err
+	}
+	outPath := filepath.Join(m.GraphDir, "image", m.Driver, "repositories.json")
+	if err := os.MkdirAll(filepath.Dir(outPath), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outPath, out, 0600)
+}
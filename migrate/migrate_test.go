@@ -0,0 +1,124 @@
+package migrate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeV1Fixture lays out a minimal graph/<id> entry (json, layersize,
+// cache-id, tar-data.json.gz) plus its driver cache dir, sufficient for
+// Migrator.Run to migrate it.
+func writeV1Fixture(t *testing.T, graphDir, driver, id, parent, cacheID string) {
+	t.Helper()
+
+	dir := filepath.Join(graphDir, "graph", id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := fmt.Sprintf(`{"id":%q,"parent":%q,"created":"2021-01-01T00:00:00Z"}`, id, parent)
+	if err := ioutil.WriteFile(filepath.Join(dir, "json"), []byte(v1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "layersize"), []byte("0"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cache-id"), []byte(cacheID), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte("layer-" + id)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "tar-data.json.gz"), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(graphDir, driver, cacheID), 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRunSetsParentAcrossMultiLayerChain confirms a child image's v2
+// config and imagedb metadata record its parent's already-migrated v2
+// image id, even though both ids are migrated in the same Run call.
+func TestRunSetsParentAcrossMultiLayerChain(t *testing.T) {
+	graphDir := t.TempDir()
+	driver := "vfs"
+
+	rootID := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	childID := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	writeV1Fixture(t, graphDir, driver, rootID, "", "cache-"+rootID)
+	writeV1Fixture(t, graphDir, driver, childID, rootID, "cache-"+childID)
+
+	m := &Migrator{GraphDir: graphDir, Driver: driver}
+	results, err := m.Run()
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+
+	byID := map[string]Result{}
+	for _, r := range results {
+		byID[r.LegacyID] = r
+	}
+	rootResult, ok := byID[rootID]
+	if !ok {
+		t.Fatalf("expected a result for root id %s", rootID)
+	}
+	childResult, ok := byID[childID]
+	if !ok {
+		t.Fatalf("expected a result for child id %s", childID)
+	}
+
+	childConfigPath := filepath.Join(graphDir, "image", driver, "imagedb", "content", "sha256", childResult.ImageID)
+	content, err := ioutil.ReadFile(childConfigPath)
+	if err != nil {
+		t.Fatalf("reading child v2 config: %s", err)
+	}
+	var v2 V2Image
+	if err := json.Unmarshal(content, &v2); err != nil {
+		t.Fatalf("parsing child v2 config: %s", err)
+	}
+	if v2.Parent != rootResult.ImageID {
+		t.Fatalf("child config parent: got %q, want %q", v2.Parent, rootResult.ImageID)
+	}
+
+	parentFile := filepath.Join(graphDir, "image", driver, "imagedb", "metadata", "sha256", childResult.ImageID, "parent")
+	got, err := ioutil.ReadFile(parentFile)
+	if err != nil {
+		t.Fatalf("reading child parent metadata: %s", err)
+	}
+	if string(got) != "sha256:"+rootResult.ImageID {
+		t.Fatalf("child parent metadata: got %q, want %q", got, "sha256:"+rootResult.ImageID)
+	}
+}
+
+func TestChainID(t *testing.T) {
+	cases := []struct {
+		name    string
+		diffIDs []string
+		want    string
+	}{
+		{name: "empty", diffIDs: nil, want: ""},
+		{name: "single diffID is its own chainID", diffIDs: []string{"deadbeef"}, want: "deadbeef"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := ChainID(c.diffIDs); got != c.want {
+				t.Fatalf("ChainID(%v): got %s, want %s", c.diffIDs, got, c.want)
+			}
+		})
+	}
+}
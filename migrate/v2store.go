@@ -0,0 +1,304 @@
+package migrate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	quotedHexRegexp = regexp.MustCompile(`"[a-fA-F0-9]{64}"`)
+	rawHexRegexp    = regexp.MustCompile(`(sha256:)?([a-fA-F0-9]{64})`)
+)
+
+// DetectLayout reports whether graphDir holds the pre-1.10 "v1" graph
+// layout or the v2 image/layer store, by probing for
+// image/<driver>/imagedb.
+func DetectLayout(graphDir, driver string) string {
+	if _, err := os.Stat(filepath.Join(graphDir, "image", driver, "imagedb")); err == nil {
+		return "v2"
+	}
+	return "v1"
+}
+
+// V2Paths collects every file under image/<driver> that can hold a
+// textual reference to a legacy or v2 image id: imagedb content (JSON,
+// quoted ids) and repositories.json go in content, everything raw
+// (layerdb cache-id/parent, imagedb metadata parent) goes in raw.
+func V2Paths(graphDir, driver string) (content, raw []string, err error) {
+	root := filepath.Join(graphDir, "image", driver)
+
+	contentDir := filepath.Join(root, "imagedb", "content", "sha256")
+	entries, err := ioutil.ReadDir(contentDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		content = append(content, filepath.Join(contentDir, e.Name()))
+	}
+
+	metaDir := filepath.Join(root, "imagedb", "metadata", "sha256")
+	metaEntries, err := ioutil.ReadDir(metaDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, e := range metaEntries {
+		p := filepath.Join(metaDir, e.Name(), "parent")
+		if _, err := os.Stat(p); err == nil {
+			raw = append(raw, p)
+		}
+	}
+
+	layerDir := filepath.Join(root, "layerdb", "sha256")
+	layerEntries, err := ioutil.ReadDir(layerDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, e := range layerEntries {
+		for _, name := range []string{"cache-id", "parent"} {
+			p := filepath.Join(layerDir, e.Name(), name)
+			if _, err := os.Stat(p); err == nil {
+				raw = append(raw, p)
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "repositories.json")); err == nil {
+		content = append(content, filepath.Join(root, "repositories.json"))
+	}
+
+	return content, raw, nil
+}
+
+// rewriteRaw substitutes bare or "sha256:"-prefixed 64-hex ids in path
+// using mapping, in place.
+func rewriteRaw(path string, mapping map[string]string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	changed := false
+	out := rawHexRegexp.ReplaceAllFunc(data, func(match []byte) []byte {
+		sub := rawHexRegexp.FindSubmatch(match)
+		if newID, ok := mapping[string(sub[2])]; ok {
+			changed = true
+			return append(append([]byte{}, sub[1]...), []byte(newID)...)
+		}
+		return match
+	})
+	if !changed {
+		return nil
+	}
+	return ioutil.WriteFile(path, out, 0600)
+}
+
+// rewriteQuoted substitutes double-quoted 64-hex ids in path using
+// mapping and returns the resulting content without writing it back,
+// since callers may need to rehash it before it is safe to persist.
+func rewriteQuoted(path string, mapping map[string]string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return quotedHexRegexp.ReplaceAllFunc(data, func(match []byte) []byte {
+		id := string(match[1 : len(match)-1])
+		if newID, ok := mapping[id]; ok {
+			return []byte(`"` + newID + `"`)
+		}
+		return match
+	}), nil
+}
+
+// RewriteV2Store rewrites every legacy-id reference it can find under
+// image/<driver> using mapping (old id -> new id), then re-derives the
+// v2 image store's content-addressed ids so the tree stays internally
+// consistent: a v2 image id embeds its parent's id, so changing a
+// parent forces every descendant to be rehashed and renamed in turn.
+// It returns the old->new mapping of v2 image ids that changed.
+func RewriteV2Store(graphDir, driver string, mapping map[string]string) (map[string]string, error) {
+	contentPaths, rawPaths, err := V2Paths(graphDir, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range rawPaths {
+		if err := rewriteRaw(p, mapping); err != nil {
+			logrus.Errorf("Error rewriting %s: %s", p, err)
+		}
+	}
+
+	repositoriesPath := filepath.Join(graphDir, "image", driver, "repositories.json")
+	configs := map[string][]byte{}
+	var repositories []byte
+	for _, p := range contentPaths {
+		out, err := rewriteQuoted(p, mapping)
+		if err != nil {
+			logrus.Errorf("Error rewriting %s: %s", p, err)
+			continue
+		}
+		if p == repositoriesPath {
+			repositories = out
+			continue
+		}
+		configs[filepath.Base(p)] = out
+	}
+
+	idMap, err := rehashImages(graphDir, driver, configs)
+	if err != nil {
+		return idMap, err
+	}
+
+	if repositories != nil {
+		if err := rewriteRepositories(repositoriesPath, repositories, idMap); err != nil {
+			return idMap, err
+		}
+	}
+
+	return idMap, nil
+}
+
+// RehashedPaths returns the new content and metadata paths rehashImages
+// created for each old id in idMap (the mapping RewriteV2Store
+// returns), i.e. the artifacts a caller needs to remove in order to
+// undo the rehash, since they have no pre-image of their own to
+// restore.
+func RehashedPaths(graphDir, driver string, idMap map[string]string) []string {
+	contentDir := filepath.Join(graphDir, "image", driver, "imagedb", "content", "sha256")
+	metaDir := filepath.Join(graphDir, "image", driver, "imagedb", "metadata", "sha256")
+
+	var paths []string
+	for _, newID := range idMap {
+		paths = append(paths, filepath.Join(contentDir, newID))
+		if _, err := os.Stat(filepath.Join(metaDir, newID)); err == nil {
+			paths = append(paths, filepath.Join(metaDir, newID))
+		}
+	}
+	return paths
+}
+
+type v2Stub struct {
+	Parent string `json:"parent,omitempty"`
+}
+
+// rehashImages walks configs (image id -> possibly-rewritten config
+// bytes) in parent-first order, patches each child's embedded "parent"
+// field to match its already-rehashed parent, recomputes the sha256 of
+// the result, and renames the on-disk content/metadata entries to the
+// new id when it changed.
+func rehashImages(graphDir, driver string, configs map[string][]byte) (map[string]string, error) {
+	parentOf := map[string]string{}
+	for id, data := range configs {
+		var stub v2Stub
+		if err := json.Unmarshal(data, &stub); err != nil {
+			return nil, fmt.Errorf("parsing image config %s: %s", id, err)
+		}
+		parentOf[id] = stub.Parent
+	}
+
+	ids := make([]string, 0, len(configs))
+	for id := range configs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var order []string
+	visited := map[string]bool{}
+	var visit func(id string)
+	visit = func(id string) {
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+		if parent := parentOf[id]; parent != "" {
+			if _, ok := configs[parent]; ok {
+				visit(parent)
+			}
+		}
+		order = append(order, id)
+	}
+	for _, id := range ids {
+		visit(id)
+	}
+
+	idMap := map[string]string{}
+	contentDir := filepath.Join(graphDir, "image", driver, "imagedb", "content", "sha256")
+	metaDir := filepath.Join(graphDir, "image", driver, "imagedb", "metadata", "sha256")
+
+	for _, oldID := range order {
+		data := configs[oldID]
+		if parent := parentOf[oldID]; parent != "" {
+			if newParent, ok := idMap[parent]; ok {
+				data = bytes.Replace(data, []byte(`"`+parent+`"`), []byte(`"`+newParent+`"`), 1)
+			}
+		}
+
+		sum := sha256.Sum256(data)
+		newID := hex.EncodeToString(sum[:])
+		if newID != oldID {
+			idMap[oldID] = newID
+			logrus.Debugf("Image %s rehashed to %s", oldID, newID)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(contentDir, newID), data, 0600); err != nil {
+			return idMap, err
+		}
+		if newID != oldID {
+			if err := os.Remove(filepath.Join(contentDir, oldID)); err != nil && !os.IsNotExist(err) {
+				return idMap, err
+			}
+		}
+
+		oldMetaDir := filepath.Join(metaDir, oldID)
+		if _, err := os.Stat(oldMetaDir); err == nil {
+			newMetaDir := filepath.Join(metaDir, newID)
+			if newID != oldID {
+				if err := os.Rename(oldMetaDir, newMetaDir); err != nil {
+					return idMap, err
+				}
+			}
+			if parent := parentOf[oldID]; parent != "" {
+				newParent := parent
+				if mapped, ok := idMap[parent]; ok {
+					newParent = mapped
+				}
+				if err := ioutil.WriteFile(filepath.Join(newMetaDir, "parent"), []byte("sha256:"+newParent), 0600); err != nil {
+					return idMap, err
+				}
+			}
+		}
+	}
+
+	return idMap, nil
+}
+
+func rewriteRepositories(path string, content []byte, idMap map[string]string) error {
+	var repos struct {
+		Repositories map[string]map[string]string
+	}
+	if err := json.Unmarshal(content, &repos); err != nil {
+		return fmt.Errorf("parsing %s: %s", path, err)
+	}
+	for _, tags := range repos.Repositories {
+		for tag, ref := range tags {
+			id := strings.TrimPrefix(ref, "sha256:")
+			if newID, ok := idMap[id]; ok {
+				tags[tag] = "sha256:" + newID
+			}
+		}
+	}
+	out, err := json.MarshalIndent(repos, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0600)
+}
@@ -0,0 +1,184 @@
+package migrate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dmcgowan/graphutil/journal"
+)
+
+// TestRehashImagesCascadesToDescendants confirms that rehashing a root
+// image whose content changed forces every descendant that embeds the
+// root's id as its "parent" to be rehashed and renamed in turn.
+func TestRehashImagesCascadesToDescendants(t *testing.T) {
+	graphDir := t.TempDir()
+	driver := "vfs"
+
+	oldRootID := "1111111111111111111111111111111111111111111111111111111111111a"
+	oldChildID := "2222222222222222222222222222222222222222222222222222222222222b"
+
+	rootData := []byte(`{"name":"root"}`)
+	childData := []byte(fmt.Sprintf(`{"parent":"%s","name":"child"}`, oldRootID))
+
+	contentDir := filepath.Join(graphDir, "image", driver, "imagedb", "content", "sha256")
+	if err := os.MkdirAll(contentDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	metaDir := filepath.Join(graphDir, "image", driver, "imagedb", "metadata", "sha256")
+	oldChildMetaDir := filepath.Join(metaDir, oldChildID)
+	if err := os.MkdirAll(oldChildMetaDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(oldChildMetaDir, "parent"), []byte("sha256:"+oldRootID), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := map[string][]byte{
+		oldRootID:  rootData,
+		oldChildID: childData,
+	}
+
+	idMap, err := rehashImages(graphDir, driver, configs)
+	if err != nil {
+		t.Fatalf("rehashImages: %s", err)
+	}
+
+	sum := sha256.Sum256(rootData)
+	wantRootID := hex.EncodeToString(sum[:])
+	if idMap[oldRootID] != wantRootID {
+		t.Fatalf("root id: got %s, want %s", idMap[oldRootID], wantRootID)
+	}
+
+	wantChildData := bytes.Replace(childData, []byte(`"`+oldRootID+`"`), []byte(`"`+wantRootID+`"`), 1)
+	childSum := sha256.Sum256(wantChildData)
+	wantChildID := hex.EncodeToString(childSum[:])
+	if idMap[oldChildID] != wantChildID {
+		t.Fatalf("child id: got %s, want %s", idMap[oldChildID], wantChildID)
+	}
+
+	if _, err := os.Stat(filepath.Join(contentDir, oldRootID)); !os.IsNotExist(err) {
+		t.Fatalf("expected old root content to be removed, got err=%v", err)
+	}
+	gotChildData, err := ioutil.ReadFile(filepath.Join(contentDir, wantChildID))
+	if err != nil {
+		t.Fatalf("reading rehashed child content: %s", err)
+	}
+	if !bytes.Equal(gotChildData, wantChildData) {
+		t.Fatalf("rehashed child content: got %q, want %q", gotChildData, wantChildData)
+	}
+
+	gotParent, err := ioutil.ReadFile(filepath.Join(metaDir, wantChildID, "parent"))
+	if err != nil {
+		t.Fatalf("reading rehashed child parent metadata: %s", err)
+	}
+	if string(gotParent) != "sha256:"+wantRootID {
+		t.Fatalf("child parent metadata: got %q, want %q", gotParent, "sha256:"+wantRootID)
+	}
+}
+
+// TestRollbackUndoesRehashCascade chains RewriteV2Store and
+// journal.Rollback together, the way runScramble/runDowngrade do: it
+// confirms rolling back a run that rehashed a parented image restores
+// the original content/metadata under their old ids and removes the
+// rehashed artifacts left under the new ones, rather than erroring out
+// or leaving them behind.
+func TestRollbackUndoesRehashCascade(t *testing.T) {
+	graphDir := t.TempDir()
+	driver := "vfs"
+
+	oldRootID := "1111111111111111111111111111111111111111111111111111111111111a"
+	oldChildID := "2222222222222222222222222222222222222222222222222222222222222b"
+
+	rootData := []byte(`{"name":"root"}`)
+	childData := []byte(fmt.Sprintf(`{"parent":"%s","name":"child"}`, oldRootID))
+
+	contentDir := filepath.Join(graphDir, "image", driver, "imagedb", "content", "sha256")
+	if err := os.MkdirAll(contentDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(contentDir, oldRootID), rootData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(contentDir, oldChildID), childData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	metaDir := filepath.Join(graphDir, "image", driver, "imagedb", "metadata", "sha256")
+	oldChildMetaDir := filepath.Join(metaDir, oldChildID)
+	if err := os.MkdirAll(oldChildMetaDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	parentPath := filepath.Join(oldChildMetaDir, "parent")
+	if err := ioutil.WriteFile(parentPath, []byte("sha256:"+oldRootID), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	j := journal.New(graphDir)
+	content, raw, err := V2Paths(graphDir, driver)
+	if err != nil {
+		t.Fatalf("V2Paths: %s", err)
+	}
+	for _, p := range append(content, raw...) {
+		if err := j.AddManagedRewriteSnapshot(p, p); err != nil {
+			t.Fatalf("AddManagedRewriteSnapshot(%s): %s", p, err)
+		}
+	}
+
+	idMap, err := RewriteV2Store(graphDir, driver, map[string]string{})
+	if err != nil {
+		t.Fatalf("RewriteV2Store: %s", err)
+	}
+	newRootID, newChildID := idMap[oldRootID], idMap[oldChildID]
+	if newRootID == "" || newChildID == "" {
+		t.Fatalf("expected both images to be rehashed, got idMap=%v", idMap)
+	}
+	for _, p := range RehashedPaths(graphDir, driver, idMap) {
+		j.AddCleanup(p)
+	}
+	j.MarkManagedDone()
+
+	if err := j.Rollback(); err != nil {
+		t.Fatalf("Rollback: %s", err)
+	}
+
+	gotRoot, err := ioutil.ReadFile(filepath.Join(contentDir, oldRootID))
+	if err != nil {
+		t.Fatalf("reading restored root content: %s", err)
+	}
+	if !bytes.Equal(gotRoot, rootData) {
+		t.Fatalf("restored root content: got %q, want %q", gotRoot, rootData)
+	}
+
+	gotChild, err := ioutil.ReadFile(filepath.Join(contentDir, oldChildID))
+	if err != nil {
+		t.Fatalf("reading restored child content: %s", err)
+	}
+	if !bytes.Equal(gotChild, childData) {
+		t.Fatalf("restored child content: got %q, want %q", gotChild, childData)
+	}
+
+	gotParent, err := ioutil.ReadFile(parentPath)
+	if err != nil {
+		t.Fatalf("reading restored child parent metadata: %s", err)
+	}
+	if string(gotParent) != "sha256:"+oldRootID {
+		t.Fatalf("restored child parent metadata: got %q, want %q", gotParent, "sha256:"+oldRootID)
+	}
+
+	if _, err := os.Stat(filepath.Join(contentDir, newRootID)); !os.IsNotExist(err) {
+		t.Fatalf("expected rehashed root content to be removed, got err=%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(contentDir, newChildID)); !os.IsNotExist(err) {
+		t.Fatalf("expected rehashed child content to be removed, got err=%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(metaDir, newChildID)); !os.IsNotExist(err) {
+		t.Fatalf("expected rehashed child metadata dir to be removed, got err=%v", err)
+	}
+}
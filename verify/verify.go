@@ -0,0 +1,290 @@
+// Package verify fscks a graph directory: it confirms every legacy
+// image's cache dir and parent chain are intact, recomputes layer
+// checksums, and confirms the repositories file(s) only reference
+// known ids.
+package verify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/dmcgowan/graphutil/migrate"
+)
+
+// Kind categorizes a Finding.
+type Kind string
+
+const (
+	KindMissingCacheDir  Kind = "missing-cache-dir"
+	KindDanglingParent   Kind = "dangling-parent"
+	KindParentCycle      Kind = "parent-cycle"
+	KindChecksumMismatch Kind = "diffid-mismatch"
+	KindDanglingRepoRef  Kind = "dangling-repository-ref"
+)
+
+// Finding is a single problem reported by Run.
+type Finding struct {
+	ID     string
+	Kind   Kind
+	Detail string
+}
+
+// Verifier walks a graph directory looking for corruption of the kind
+// scramble/downgrade can leave behind.
+type Verifier struct {
+	GraphDir string
+	Driver   string
+}
+
+// Run walks graph/ (and, when present, image/<driver>/layerdb) and
+// returns every problem it finds.
+func (v *Verifier) Run() ([]Finding, error) {
+	var findings []Finding
+
+	var ids []string
+	if err := migrate.WalkGraphIDs(v.GraphDir, func(id string) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		known[id] = true
+	}
+
+	v2Present := v.hasLayerdb()
+
+	for _, id := range ids {
+		findings = append(findings, v.checkImage(id, known, v2Present)...)
+	}
+
+	findings = append(findings, v.checkRepositories(known)...)
+
+	return findings, nil
+}
+
+func (v *Verifier) hasLayerdb() bool {
+	_, err := os.Stat(filepath.Join(v.GraphDir, "image", v.Driver, "layerdb"))
+	return err == nil
+}
+
+func (v *Verifier) checkImage(id string, known map[string]bool, v2Present bool) []Finding {
+	var findings []Finding
+
+	cacheBytes, err := ioutil.ReadFile(filepath.Join(v.GraphDir, "graph", id, "cache-id"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			findings = append(findings, Finding{ID: id, Kind: KindMissingCacheDir, Detail: err.Error()})
+		}
+	} else {
+		cacheID := strings.TrimSpace(string(cacheBytes))
+		cacheDir := filepath.Join(v.GraphDir, v.Driver, cacheID)
+		if _, err := os.Stat(cacheDir); err != nil {
+			findings = append(findings, Finding{ID: id, Kind: KindMissingCacheDir, Detail: fmt.Sprintf("%s: %s", cacheDir, err)})
+		}
+	}
+
+	v1, err := migrate.ReadV1Image(v.GraphDir, id)
+	if err != nil {
+		return findings
+	}
+
+	if v1.Parent != "" && !known[v1.Parent] {
+		findings = append(findings, Finding{ID: id, Kind: KindDanglingParent, Detail: fmt.Sprintf("parent %s does not exist", v1.Parent)})
+	} else if v1.Parent != "" {
+		if cycle := findCycle(v.GraphDir, id, len(known)); cycle != "" {
+			findings = append(findings, Finding{ID: id, Kind: KindParentCycle, Detail: cycle})
+		}
+	}
+
+	if v2Present {
+		if finding, ok := v.checkChecksum(id); ok {
+			findings = append(findings, finding)
+		}
+	}
+
+	return findings
+}
+
+// findCycle walks id's parent chain up to limit+1 hops, returning a
+// description of the cycle if id reappears, or "" if the chain
+// terminates cleanly.
+func findCycle(graphDir, id string, limit int) string {
+	seen := map[string]bool{id: true}
+	cur := id
+	for i := 0; i <= limit; i++ {
+		v1, err := migrate.ReadV1Image(graphDir, cur)
+		if err != nil || v1.Parent == "" {
+			return ""
+		}
+		if seen[v1.Parent] {
+			return fmt.Sprintf("parent chain cycles back to %s via %s", v1.Parent, cur)
+		}
+		seen[v1.Parent] = true
+		cur = v1.Parent
+	}
+	return fmt.Sprintf("parent chain exceeds %d hops without terminating", limit)
+}
+
+// checkChecksum recomputes id's own layer DiffID from tar-data.json.gz
+// and compares it against the "diff" file of its v2 layerdb entry.
+func (v *Verifier) checkChecksum(id string) (Finding, bool) {
+	chain, err := migrate.Ancestry(v.GraphDir, id)
+	if err != nil {
+		return Finding{}, false
+	}
+
+	var diffIDs []string
+	for _, layerID := range chain {
+		diffID, err := migrate.DiffIDFromTarDataGz(v.GraphDir, layerID)
+		if err != nil {
+			return Finding{ID: id, Kind: KindChecksumMismatch, Detail: fmt.Sprintf("recomputing diffID for %s: %s", layerID, err)}, true
+		}
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	chainID := migrate.ChainID(diffIDs)
+	diffFile := filepath.Join(v.GraphDir, "image", v.Driver, "layerdb", "sha256", chainID, "diff")
+	stored, err := ioutil.ReadFile(diffFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Finding{}, false
+		}
+		return Finding{ID: id, Kind: KindChecksumMismatch, Detail: err.Error()}, true
+	}
+
+	expected := "sha256:" + diffIDs[len(diffIDs)-1]
+	if strings.TrimSpace(string(stored)) != expected {
+		return Finding{ID: id, Kind: KindChecksumMismatch, Detail: fmt.Sprintf("layerdb has %s, recomputed %s", stored, expected)}, true
+	}
+
+	return Finding{}, false
+}
+
+// checkRepositories confirms repositories-<driver> and
+// image/<driver>/repositories.json only reference known ids.
+func (v *Verifier) checkRepositories(known map[string]bool) []Finding {
+	var findings []Finding
+
+	legacyPath := filepath.Join(v.GraphDir, fmt.Sprintf("repositories-%s", v.Driver))
+	if content, err := ioutil.ReadFile(legacyPath); err == nil {
+		var repos struct {
+			Repositories map[string]map[string]string
+		}
+		if err := json.Unmarshal(content, &repos); err == nil {
+			for repo, tags := range repos.Repositories {
+				for tag, id := range tags {
+					if !known[id] {
+						findings = append(findings, Finding{
+							ID:     id,
+							Kind:   KindDanglingRepoRef,
+							Detail: fmt.Sprintf("%s: %s:%s", legacyPath, repo, tag),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	v2Path := filepath.Join(v.GraphDir, "image", v.Driver, "repositories.json")
+	if content, err := ioutil.ReadFile(v2Path); err == nil {
+		var repos struct {
+			Repositories map[string]map[string]string
+		}
+		if err := json.Unmarshal(content, &repos); err == nil {
+			contentDir := filepath.Join(v.GraphDir, "image", v.Driver, "imagedb", "content", "sha256")
+			for repo, tags := range repos.Repositories {
+				for tag, ref := range tags {
+					id := strings.TrimPrefix(ref, "sha256:")
+					if _, err := os.Stat(filepath.Join(contentDir, id)); err != nil {
+						findings = append(findings, Finding{
+							ID:     id,
+							Kind:   KindDanglingRepoRef,
+							Detail: fmt.Sprintf("%s: %s:%s", v2Path, repo, tag),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	return findings
+}
+
+// Fix drops dangling repository references and deletes orphaned graph
+// entries (ids with a dangling or cyclic parent) for the given
+// findings.
+func (v *Verifier) Fix(findings []Finding) error {
+	for _, f := range findings {
+		switch f.Kind {
+		case KindDanglingRepoRef:
+			if err := v.dropRepositoryRef(f); err != nil {
+				return err
+			}
+		case KindDanglingParent, KindParentCycle:
+			dir := filepath.Join(v.GraphDir, "graph", f.ID)
+			logrus.Debugf("Removing orphaned graph entry %s", dir)
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *Verifier) dropRepositoryRef(f Finding) error {
+	legacyPath := filepath.Join(v.GraphDir, fmt.Sprintf("repositories-%s", v.Driver))
+	v2Path := filepath.Join(v.GraphDir, "image", v.Driver, "repositories.json")
+
+	if strings.HasPrefix(f.Detail, legacyPath) {
+		return dropRepositoryEntry(legacyPath, f.Detail)
+	}
+	if strings.HasPrefix(f.Detail, v2Path) {
+		return dropRepositoryEntry(v2Path, f.Detail)
+	}
+	return nil
+}
+
+func dropRepositoryEntry(path, detail string) error {
+	repo, tag, err := parseRepoTag(path, detail)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var repos struct {
+		Repositories map[string]map[string]string
+	}
+	if err := json.Unmarshal(content, &repos); err != nil {
+		return err
+	}
+	delete(repos.Repositories[repo], tag)
+	out, err := json.MarshalIndent(repos, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0600)
+}
+
+// parseRepoTag extracts "repo" and "tag" from a Detail string of the
+// form "<path>: <repo>:<tag>". It splits on the last colon, since repo
+// may itself contain one (e.g. a registry host with a port, as in
+// "myregistry:5000/image:latest") while a tag never does.
+func parseRepoTag(path, detail string) (repo, tag string, err error) {
+	ref := strings.TrimPrefix(detail, path+": ")
+	i := strings.LastIndex(ref, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("malformed repository reference detail: %s", detail)
+	}
+	return ref[:i], ref[i+1:], nil
+}
@@ -0,0 +1,145 @@
+package verify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeV1Image(t *testing.T, graphDir, id, parent string) {
+	t.Helper()
+	dir := filepath.Join(graphDir, "graph", id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := fmt.Sprintf(`{"id":%q,"parent":%q}`, id, parent)
+	if err := ioutil.WriteFile(filepath.Join(dir, "json"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindCycle(t *testing.T) {
+	cases := []struct {
+		name      string
+		build     func(t *testing.T, graphDir string)
+		id        string
+		limit     int
+		wantCycle bool
+	}{
+		{
+			name: "acyclic chain terminates cleanly",
+			build: func(t *testing.T, graphDir string) {
+				writeV1Image(t, graphDir, "a", "b")
+				writeV1Image(t, graphDir, "b", "c")
+				writeV1Image(t, graphDir, "c", "")
+			},
+			id:        "a",
+			limit:     10,
+			wantCycle: false,
+		},
+		{
+			name: "direct cycle is detected",
+			build: func(t *testing.T, graphDir string) {
+				writeV1Image(t, graphDir, "a", "b")
+				writeV1Image(t, graphDir, "b", "a")
+			},
+			id:        "a",
+			limit:     10,
+			wantCycle: true,
+		},
+		{
+			name: "chain exceeding the hop limit is reported",
+			build: func(t *testing.T, graphDir string) {
+				writeV1Image(t, graphDir, "a", "b")
+				writeV1Image(t, graphDir, "b", "c")
+				writeV1Image(t, graphDir, "c", "d")
+				writeV1Image(t, graphDir, "d", "")
+			},
+			id:        "a",
+			limit:     1,
+			wantCycle: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			graphDir := t.TempDir()
+			c.build(t, graphDir)
+
+			got := findCycle(graphDir, c.id, c.limit)
+			if c.wantCycle && got == "" {
+				t.Fatal("expected a cycle description, got none")
+			}
+			if !c.wantCycle && got != "" {
+				t.Fatalf("expected no cycle, got %q", got)
+			}
+		})
+	}
+}
+
+func TestParseRepoTag(t *testing.T) {
+	cases := []struct {
+		name    string
+		repo    string
+		tag     string
+		wantErr bool
+	}{
+		{name: "simple repo", repo: "myimage", tag: "latest"},
+		{name: "repo with a registry port", repo: "myregistry:5000/myimage", tag: "latest"},
+	}
+
+	path := "/graph/repositories-vfs"
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			detail := fmt.Sprintf("%s: %s:%s", path, c.repo, c.tag)
+			repo, tag, err := parseRepoTag(path, detail)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRepoTag: %s", err)
+			}
+			if repo != c.repo || tag != c.tag {
+				t.Fatalf("parseRepoTag(%q): got (%q, %q), want (%q, %q)", detail, repo, tag, c.repo, c.tag)
+			}
+		})
+	}
+}
+
+func TestDropRepositoryEntryHandlesColonInRepoName(t *testing.T) {
+	graphDir := t.TempDir()
+	path := filepath.Join(graphDir, "repositories-vfs")
+	content := `{"Repositories":{"myregistry:5000/myimage":{"latest":"deadbeef","v1":"deadbeef"}}}`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	detail := fmt.Sprintf("%s: myregistry:5000/myimage:latest", path)
+	if err := dropRepositoryEntry(path, detail); err != nil {
+		t.Fatalf("dropRepositoryEntry: %s", err)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var repos struct {
+		Repositories map[string]map[string]string
+	}
+	if err := json.Unmarshal(got, &repos); err != nil {
+		t.Fatalf("parsing rewritten repositories file: %s", err)
+	}
+	tags := repos.Repositories["myregistry:5000/myimage"]
+	if _, ok := tags["latest"]; ok {
+		t.Fatal("expected the latest tag to be dropped")
+	}
+	if _, ok := tags["v1"]; !ok {
+		t.Fatal("expected the v1 tag to survive")
+	}
+}